@@ -0,0 +1,372 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/open-policy-agent/opa/rego"
+)
+
+// opaPayload is the document sent to OPA, whether over HTTP or evaluated
+// in-process against a prepared rego query. It mirrors the richer input
+// shape used by policy gateways like rond-authz, so a single policy can
+// differentiate read vs. write requests, gate specific endpoints, and so
+// on, instead of only ever seeing the label being enforced.
+type opaPayload struct {
+	Input struct {
+		HTTP struct {
+			Method     string              `json:"method"`
+			Path       string              `json:"path"`
+			Query      map[string][]string `json:"query"`
+			RemoteAddr string              `json:"remote_addr"`
+			Headers    map[string][]string `json:"headers"`
+		} `json:"http"`
+		Label map[string][]string `json:"label"`
+	} `json:"input"`
+}
+
+type opaResponse struct {
+	Result struct {
+		Allow bool `json:"allow"`
+		// Tenants, when non-empty, overrides the label value(s) passed in
+		// the request with the set the policy actually authorizes -
+		// e.g. for a user authorized for "tenant in {a,b,c}" who only
+		// asked for "a" in this request. Absent for policies that only
+		// return the legacy single-tenant Allow boolean.
+		Tenants []string `json:"tenants,omitempty"`
+	} `json:"result"`
+}
+
+// Authorizer decides whether a request carrying the given label value(s)
+// is allowed to proceed. On success it may return the label value(s) that
+// should actually be enforced, which can differ from vals (e.g. an OPA
+// policy authorizing a broader or narrower set of tenants); a nil or empty
+// slice means "enforce vals unchanged". Implementations must be safe for
+// concurrent use.
+type Authorizer interface {
+	Authorize(req *http.Request, vals []string) (int, string, []string, error)
+}
+
+// httpAuthorizer delegates the authorization decision to a remote OPA
+// server over HTTP, as prom-label-proxy has always done.
+type httpAuthorizer struct {
+	label        string
+	client       *http.Client
+	opaURL       string
+	headerFilter *headerFilter
+}
+
+// NewHTTPAuthorizer returns an Authorizer that POSTs the OPA input document
+// to opaHTTPAuthzEndpoint for every request. headerAllow/headerDeny, when
+// non-empty, restrict which request headers are included in that document;
+// see newHeaderFilter.
+func NewHTTPAuthorizer(label, opaHTTPAuthzEndpoint string, headerAllow, headerDeny []string) Authorizer {
+	return &httpAuthorizer{
+		label:        label,
+		client:       &http.Client{},
+		opaURL:       opaHTTPAuthzEndpoint,
+		headerFilter: newHeaderFilter(headerAllow, headerDeny),
+	}
+}
+
+func buildOPAPayload(label string, req *http.Request, vals []string, hf *headerFilter) opaPayload {
+	var p opaPayload
+
+	p.Input.HTTP.Method = req.Method
+	p.Input.HTTP.Path = req.URL.Path
+	p.Input.HTTP.RemoteAddr = req.RemoteAddr
+
+	query := req.URL.Query()
+	query.Del(label)
+	p.Input.HTTP.Query = query
+
+	headers := make(map[string][]string)
+	for name, values := range req.Header {
+		if hf.permits(name) {
+			headers[name] = values
+		}
+	}
+	p.Input.HTTP.Headers = headers
+
+	l := make(map[string][]string)
+	l[label] = vals
+	p.Input.Label = l
+
+	return p
+}
+
+func (a *httpAuthorizer) Authorize(req *http.Request, vals []string) (int, string, []string, error) {
+	payload, err := json.Marshal(buildOPAPayload(a.label, req, vals, a.headerFilter))
+	if err != nil {
+		errorString := fmt.Sprintf("%v %v - failed to marshal OPA payload", http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return http.StatusInternalServerError, errorString, nil, err
+	}
+
+	opaReq, err := http.NewRequest("POST", a.opaURL, bytes.NewBuffer(payload))
+	if err != nil {
+		errorString := fmt.Sprintf("%v %v - failed to create OPA HTTP request", http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return http.StatusInternalServerError, errorString, nil, err
+	}
+
+	resp, err := a.client.Do(opaReq)
+	if err != nil {
+		errorString := fmt.Sprintf("%v %v - failed to execute OPA HTTP request", http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return http.StatusInternalServerError, errorString, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		errorString := fmt.Sprintf("%v %v - failed to read OPA response body", http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return http.StatusInternalServerError, errorString, nil, err
+	}
+
+	opaResp := &opaResponse{}
+	if err := json.Unmarshal(body, opaResp); err != nil {
+		errorString := fmt.Sprintf("%v %v - failed to unmarshal to OPA response struct", http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return http.StatusInternalServerError, errorString, nil, err
+	}
+
+	if opaResp.Result.Allow {
+		return http.StatusOK, http.StatusText(http.StatusOK), opaResp.Result.Tenants, nil
+	}
+
+	errorString := fmt.Sprintf("%v %v - User not authorized", http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+	return http.StatusUnauthorized, errorString, nil, nil
+}
+
+// decisionLogEntry is written to stdout as a single JSON line for every
+// decision the regoAuthorizer makes, so operators can audit authorization
+// outcomes without instrumenting the policy itself.
+type decisionLogEntry struct {
+	Label   string   `json:"label"`
+	Values  []string `json:"values"`
+	Allowed bool     `json:"allowed"`
+	Error   string   `json:"error,omitempty"`
+}
+
+func logDecision(e decisionLogEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("failed to marshal decision log entry: %v", err)
+		return
+	}
+	fmt.Fprintln(os.Stdout, string(b))
+}
+
+// regoAuthorizer evaluates the same input document in-process against a
+// rego.PreparedEvalQuery, avoiding the HTTP round-trip to an external OPA
+// server. The prepared query is rebuilt whenever the process receives
+// SIGHUP or the underlying bundle directory changes, so operators can roll
+// out policy updates without restarting the proxy.
+type regoAuthorizer struct {
+	label        string
+	policyFile   string
+	policyBundle string
+	headerFilter *headerFilter
+
+	mtx          sync.RWMutex
+	allowQuery   rego.PreparedEvalQuery
+	tenantsQuery rego.PreparedEvalQuery
+}
+
+// NewRegoAuthorizer returns an Authorizer that evaluates policy in-process,
+// loaded from either a single policy file or a bundle directory. Exactly
+// one of policyFile, policyBundle should be set. The policy must define
+// data.prom_label_proxy.allow and may optionally define
+// data.prom_label_proxy.tenants (defaulting to an empty array) to override
+// the tenant(s) to enforce. headerAllow/headerDeny, when non-empty,
+// restrict which request headers are included in the policy input; see
+// newHeaderFilter.
+func NewRegoAuthorizer(label, policyFile, policyBundle string, headerAllow, headerDeny []string) (Authorizer, error) {
+	a := &regoAuthorizer{
+		label:        label,
+		policyFile:   policyFile,
+		policyBundle: policyBundle,
+		headerFilter: newHeaderFilter(headerAllow, headerDeny),
+	}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	a.watchSIGHUP()
+	return a, nil
+}
+
+func (a *regoAuthorizer) reload() error {
+	ctx := context.Background()
+
+	var loadOpt func(*rego.Rego)
+	if a.policyBundle != "" {
+		loadOpt = rego.LoadBundle(a.policyBundle)
+	} else {
+		loadOpt = rego.Load([]string{a.policyFile}, nil)
+	}
+
+	// allow and tenants are prepared as two independent queries, not one
+	// conjunctive "allow = ...; tenants = ..." query: in Rego a conjunctive
+	// query fails entirely (zero result sets) if any conjunct is
+	// undefined, so a policy that only defines allow - exactly the
+	// documented backward-compatible case - would otherwise always be
+	// evaluated as denied.
+	allowQuery, err := rego.New(rego.Query("allow = data.prom_label_proxy.allow"), loadOpt).PrepareForEval(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to prepare rego allow query: %w", err)
+	}
+
+	tenantsQuery, err := rego.New(rego.Query("tenants = data.prom_label_proxy.tenants"), loadOpt).PrepareForEval(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to prepare rego tenants query: %w", err)
+	}
+
+	a.mtx.Lock()
+	a.allowQuery = allowQuery
+	a.tenantsQuery = tenantsQuery
+	a.mtx.Unlock()
+	return nil
+}
+
+// watchSIGHUP reloads the prepared query whenever the process receives
+// SIGHUP, allowing operators to roll out a new policy file or bundle
+// in place.
+func (a *regoAuthorizer) watchSIGHUP() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			if err := a.reload(); err != nil {
+				log.Printf("failed to reload rego policy: %v", err)
+			}
+		}
+	}()
+}
+
+func (a *regoAuthorizer) Authorize(req *http.Request, vals []string) (int, string, []string, error) {
+	payload := buildOPAPayload(a.label, req, vals, a.headerFilter)
+
+	a.mtx.RLock()
+	allowQuery := a.allowQuery
+	tenantsQuery := a.tenantsQuery
+	a.mtx.RUnlock()
+
+	rs, err := allowQuery.Eval(req.Context(), rego.EvalInput(payload.Input))
+	if err != nil {
+		logDecision(decisionLogEntry{Label: a.label, Values: vals, Error: err.Error()})
+		errorString := fmt.Sprintf("%v %v - failed to evaluate rego policy", http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return http.StatusInternalServerError, errorString, nil, err
+	}
+
+	var allow bool
+	if len(rs) > 0 {
+		allow, _ = rs[0].Bindings["allow"].(bool)
+	}
+
+	// tenants is optional, so it is evaluated separately from allow: an
+	// undefined data.prom_label_proxy.tenants rule yields zero result
+	// sets here rather than failing the allow decision above. It's only
+	// evaluated when the request is actually allowed, since a denied
+	// request has no use for it.
+	var tenants []string
+	if allow {
+		trs, err := tenantsQuery.Eval(req.Context(), rego.EvalInput(payload.Input))
+		if err == nil && len(trs) > 0 {
+			if raw, ok := trs[0].Bindings["tenants"].([]interface{}); ok {
+				for _, t := range raw {
+					if s, ok := t.(string); ok {
+						tenants = append(tenants, s)
+					}
+				}
+			}
+		}
+	}
+	logDecision(decisionLogEntry{Label: a.label, Values: vals, Allowed: allow})
+
+	if allow {
+		return http.StatusOK, http.StatusText(http.StatusOK), tenants, nil
+	}
+
+	errorString := fmt.Sprintf("%v %v - User not authorized", http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+	return http.StatusUnauthorized, errorString, nil, nil
+}
+
+// noopAuthorizer allows every request without consulting any policy
+// engine. It is useful for local development or deployments that rely
+// solely on upstream authentication.
+type noopAuthorizer struct{}
+
+// NewNoopAuthorizer returns an Authorizer that always allows the request.
+func NewNoopAuthorizer() Authorizer {
+	return noopAuthorizer{}
+}
+
+func (noopAuthorizer) Authorize(*http.Request, []string) (int, string, []string, error) {
+	return http.StatusOK, http.StatusText(http.StatusOK), nil, nil
+}
+
+// staticAllowListAuthorizer allows a request only if every one of its
+// label values appears in a fixed set of values loaded from disk at
+// construction time.
+type staticAllowListAuthorizer struct {
+	allowed map[string]struct{}
+}
+
+// NewStaticAllowListAuthorizer returns an Authorizer backed by a file of
+// allowed label values, one per line; blank lines and lines starting with
+// "#" are ignored. The proxy must be restarted to pick up changes to the
+// file.
+func NewStaticAllowListAuthorizer(path string) (Authorizer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open allow-list file: %w", err)
+	}
+	defer f.Close()
+
+	allowed := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		v := strings.TrimSpace(scanner.Text())
+		if v == "" || strings.HasPrefix(v, "#") {
+			continue
+		}
+		allowed[v] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read allow-list file: %w", err)
+	}
+
+	return &staticAllowListAuthorizer{allowed: allowed}, nil
+}
+
+func (a *staticAllowListAuthorizer) Authorize(_ *http.Request, vals []string) (int, string, []string, error) {
+	for _, val := range vals {
+		if _, ok := a.allowed[val]; !ok {
+			errorString := fmt.Sprintf("%v %v - %q is not in the allow-list", http.StatusForbidden, http.StatusText(http.StatusForbidden), val)
+			return http.StatusForbidden, errorString, nil, nil
+		}
+	}
+
+	return http.StatusOK, http.StatusText(http.StatusOK), nil, nil
+}
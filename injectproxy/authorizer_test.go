@@ -0,0 +1,116 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePolicy writes rego source to a temp file and returns its path, for
+// NewRegoAuthorizer to load.
+func writePolicy(t *testing.T, rego string) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "policy.rego")
+	if err := os.WriteFile(path, []byte(rego), 0o644); err != nil {
+		t.Fatalf("failed to write policy: %v", err)
+	}
+	return path
+}
+
+// regoAuthorizerCase exercises the in-process rego authorizer end to end
+// against the real rego package, guarding against the two bugs a prior
+// review caught by reading the code rather than running it: a bare
+// rego.Query() result lands in Expressions, not Bindings, and a
+// conjunctive "allow = ...; tenants = ..." query fails outright (rather
+// than just leaving tenants empty) whenever a policy only defines allow.
+func TestRegoAuthorizer(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		policy      string
+		wantStatus  int
+		wantTenants []string
+	}{
+		{
+			name: "single-tenant policy with no tenants rule is still allowed",
+			policy: `package prom_label_proxy
+
+default allow = false
+
+allow {
+	input.label.namespace[_] == "team-a"
+}
+`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "policy defining tenants overrides the enforced label values",
+			policy: `package prom_label_proxy
+
+default allow = false
+
+allow {
+	input.label.namespace[_] == "team-a"
+}
+
+tenants := ["team-a", "team-b"]
+`,
+			wantStatus:  http.StatusOK,
+			wantTenants: []string{"team-a", "team-b"},
+		},
+		{
+			name: "denied request",
+			policy: `package prom_label_proxy
+
+default allow = false
+`,
+			wantStatus: http.StatusUnauthorized,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := NewRegoAuthorizer("namespace", writePolicy(t, tc.policy), "", nil, nil)
+			if err != nil {
+				t.Fatalf("NewRegoAuthorizer: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+			status, _, tenants, err := a.Authorize(req, []string{"team-a"})
+			if err != nil {
+				t.Fatalf("Authorize: %v", err)
+			}
+			if status != tc.wantStatus {
+				t.Fatalf("got status %d, want %d", status, tc.wantStatus)
+			}
+			if !equalStrings(tenants, tc.wantTenants) {
+				t.Fatalf("got tenants %v, want %v", tenants, tc.wantTenants)
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import "net/http"
+
+// headerFilter controls which request headers are forwarded to the policy
+// engine as part of the OPA input document, so operators can keep
+// sensitive headers (session cookies, internal routing headers, ...) out
+// of policy input and decision logs. A nil *headerFilter permits every
+// header.
+type headerFilter struct {
+	allow map[string]struct{}
+	deny  map[string]struct{}
+}
+
+// newHeaderFilter builds a headerFilter from a set of header names to
+// allow and deny. An empty allow list means "allow everything that isn't
+// denied"; deny always takes precedence over allow.
+func newHeaderFilter(allow, deny []string) *headerFilter {
+	f := &headerFilter{
+		allow: make(map[string]struct{}, len(allow)),
+		deny:  make(map[string]struct{}, len(deny)),
+	}
+	for _, h := range allow {
+		f.allow[http.CanonicalHeaderKey(h)] = struct{}{}
+	}
+	for _, h := range deny {
+		f.deny[http.CanonicalHeaderKey(h)] = struct{}{}
+	}
+	return f
+}
+
+// permits reports whether header name may be forwarded to the policy
+// engine.
+func (f *headerFilter) permits(name string) bool {
+	if f == nil {
+		return true
+	}
+
+	name = http.CanonicalHeaderKey(name)
+	if _, denied := f.deny[name]; denied {
+		return false
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	_, allowed := f.allow[name]
+	return allowed
+}
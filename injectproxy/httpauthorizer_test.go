@@ -0,0 +1,75 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPAuthorizer(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		response    string
+		wantStatus  int
+		wantTenants []string
+	}{
+		{
+			name:       "allowed",
+			response:   `{"result": {"allow": true}}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:        "allowed with tenants override",
+			response:    `{"result": {"allow": true, "tenants": ["team-a", "team-b"]}}`,
+			wantStatus:  http.StatusOK,
+			wantTenants: []string{"team-a", "team-b"},
+		},
+		{
+			name:       "denied",
+			response:   `{"result": {"allow": false}}`,
+			wantStatus: http.StatusUnauthorized,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				var payload opaPayload
+				if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+					t.Fatalf("failed to decode OPA payload: %v", err)
+				}
+				if got := payload.Input.Label["namespace"]; !equalStrings(got, []string{"team-a"}) {
+					t.Fatalf("got label values %v, want [team-a]", got)
+				}
+				w.Write([]byte(tc.response))
+			}))
+			defer opa.Close()
+
+			a := NewHTTPAuthorizer("namespace", opa.URL, nil, nil)
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+
+			status, _, tenants, err := a.Authorize(req, []string{"team-a"})
+			if err != nil {
+				t.Fatalf("Authorize: %v", err)
+			}
+			if status != tc.wantStatus {
+				t.Fatalf("got status %d, want %d", status, tc.wantStatus)
+			}
+			if !equalStrings(tenants, tc.wantTenants) {
+				t.Fatalf("got tenants %v, want %v", tenants, tc.wantTenants)
+			}
+		})
+	}
+}
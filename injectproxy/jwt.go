@@ -0,0 +1,193 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// jwtLabelExtractor pulls the label value(s) out of a claim in a bearer
+// token, instead of the raw query string. It is wired in ahead of the
+// query-string fallback so that callers no longer have to duplicate the
+// tenant in every request.
+type jwtLabelExtractor struct {
+	header string
+	claim  string
+
+	keyFunc      jwt.Keyfunc
+	validMethods []string
+	jwks         *jwksCache
+}
+
+// NewJWTLabelExtractor returns a jwtLabelExtractor that reads the bearer
+// token from header (e.g. "Authorization"), verifies its signature, and
+// extracts claim. claim may be a dotted path (e.g.
+// "resource_access.prom.tenant") to reach a nested claim. Exactly one of
+// jwksURL, secret must be set: jwksURL verifies against keys fetched from a
+// JWKS endpoint, secret verifies an HMAC-signed token.
+func NewJWTLabelExtractor(header, claim, jwksURL, secret string) (*jwtLabelExtractor, error) {
+	if header == "" {
+		header = "Authorization"
+	}
+	if claim == "" {
+		return nil, fmt.Errorf("jwt claim must not be empty")
+	}
+
+	e := &jwtLabelExtractor{header: header, claim: claim}
+
+	switch {
+	case jwksURL != "":
+		cache, err := newJWKSCache(jwksURL, 5*time.Minute)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize JWKS cache: %w", err)
+		}
+		e.jwks = cache
+		e.keyFunc = cache.keyFunc
+		e.validMethods = []string{"RS256", "RS384", "RS512"}
+	case secret != "":
+		e.keyFunc = func(*jwt.Token) (interface{}, error) {
+			return []byte(secret), nil
+		}
+		e.validMethods = []string{"HS256", "HS384", "HS512"}
+	default:
+		return nil, fmt.Errorf("either jwksURL or secret must be set")
+	}
+
+	return e, nil
+}
+
+// Extract returns the label value(s) found in the configured claim of the
+// bearer token carried by req. A claim that holds a JSON array yields one
+// value per array element, to support users authorized for more than one
+// tenant.
+func (e *jwtLabelExtractor) Extract(req *http.Request) ([]string, error) {
+	raw := req.Header.Get(e.header)
+	raw = strings.TrimPrefix(raw, "Bearer ")
+	if raw == "" {
+		return nil, fmt.Errorf("missing bearer token in %q header", e.header)
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(raw, claims, e.keyFunc, jwt.WithValidMethods(e.validMethods)); err != nil {
+		return nil, fmt.Errorf("failed to verify bearer token: %w", err)
+	}
+
+	value, ok := lookupClaim(claims, e.claim)
+	if !ok {
+		return nil, fmt.Errorf("claim %q not found in token", e.claim)
+	}
+
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, elem := range v {
+			s, ok := elem.(string)
+			if !ok {
+				return nil, fmt.Errorf("claim %q contains a non-string array element", e.claim)
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("claim %q has unsupported type %T", e.claim, value)
+	}
+}
+
+// lookupClaim walks a dotted path (e.g. "resource_access.prom.tenant")
+// through a chain of nested maps.
+func lookupClaim(claims jwt.MapClaims, path string) (interface{}, bool) {
+	var cur interface{} = map[string]interface{}(claims)
+	for _, part := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		cur, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// jwksCache fetches a JWKS document periodically in the background so that
+// verifying a token never has to wait on a network round-trip.
+type jwksCache struct {
+	url string
+
+	mtx  sync.RWMutex
+	keys map[string]interface{}
+}
+
+func newJWKSCache(url string, refresh time.Duration) (*jwksCache, error) {
+	c := &jwksCache{url: url}
+	if err := c.fetch(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(refresh)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := c.fetch(); err != nil {
+				// Keep serving the last known-good key set; the next
+				// tick will try again.
+				continue
+			}
+		}
+	}()
+
+	return c, nil
+}
+
+func (c *jwksCache) fetch() error {
+	resp, err := http.Get(c.url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS from %q: %w", c.url, err)
+	}
+	defer resp.Body.Close()
+
+	keys, err := parseJWKS(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	c.mtx.Lock()
+	c.keys = keys
+	c.mtx.Unlock()
+	return nil
+}
+
+func (c *jwksCache) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, fmt.Errorf("token header has no \"kid\"")
+	}
+
+	c.mtx.RLock()
+	key, ok := c.keys[kid]
+	c.mtx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no key found in JWKS for kid %q", kid)
+	}
+	return key, nil
+}
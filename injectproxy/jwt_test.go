@@ -0,0 +1,111 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const jwtTestSecret = "test-secret"
+
+func signedToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	signed, err := token.SignedString([]byte(jwtTestSecret))
+	if err != nil {
+		t.Fatalf("failed to sign test token: %v", err)
+	}
+	return signed
+}
+
+func TestJWTLabelExtractorExtract(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		claim      string
+		claims     jwt.MapClaims
+		wantValues []string
+		wantErr    bool
+	}{
+		{
+			name:       "flat claim",
+			claim:      "tenant",
+			claims:     jwt.MapClaims{"tenant": "team-a"},
+			wantValues: []string{"team-a"},
+		},
+		{
+			name:  "dotted path claim",
+			claim: "resource_access.prom.tenant",
+			claims: jwt.MapClaims{
+				"resource_access": map[string]interface{}{
+					"prom": map[string]interface{}{
+						"tenant": "team-a",
+					},
+				},
+			},
+			wantValues: []string{"team-a"},
+		},
+		{
+			name:       "array claim yields one value per element",
+			claim:      "tenants",
+			claims:     jwt.MapClaims{"tenants": []interface{}{"team-a", "team-b"}},
+			wantValues: []string{"team-a", "team-b"},
+		},
+		{
+			name:    "missing claim",
+			claim:   "tenant",
+			claims:  jwt.MapClaims{"other": "value"},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := NewJWTLabelExtractor("", tc.claim, "", jwtTestSecret)
+			if err != nil {
+				t.Fatalf("NewJWTLabelExtractor: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			req.Header.Set("Authorization", "Bearer "+signedToken(t, tc.claims))
+
+			values, err := e.Extract(req)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Extract: %v", err)
+			}
+			if !equalStrings(values, tc.wantValues) {
+				t.Fatalf("got values %v, want %v", values, tc.wantValues)
+			}
+		})
+	}
+}
+
+func TestJWTLabelExtractorExtractMissingToken(t *testing.T) {
+	e, err := NewJWTLabelExtractor("", "tenant", "", jwtTestSecret)
+	if err != nil {
+		t.Fatalf("NewJWTLabelExtractor: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	if _, err := e.Extract(req); err == nil {
+		t.Fatal("expected an error for a request with no bearer token")
+	}
+}
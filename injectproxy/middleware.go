@@ -0,0 +1,96 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Middleware wraps an http.Handler to add one stage of request processing
+// (label extraction, authorization, rate limiting, logging, ...) ahead of
+// the handler it wraps.
+type Middleware func(http.Handler) http.Handler
+
+// chain composes middlewares around final, in the order given: the first
+// middleware in the slice is the outermost, i.e. the first to see the
+// request.
+func chain(final http.Handler, middlewares ...Middleware) http.Handler {
+	h := final
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// labelExtractorMiddleware determines the tenant label value for a request
+// (via JWT claim or query string, see labelValue) and stores it on the
+// context for the stages that follow.
+func (r *routes) labelExtractorMiddleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			values, err := r.labelValues(req)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Bad request. %v", err), http.StatusBadRequest)
+				return
+			}
+			next.ServeHTTP(w, req.WithContext(withRawLabelValue(req.Context(), values...)))
+		})
+	}
+}
+
+// authorizerMiddleware runs the configured Authorizer against the label
+// value(s) the LabelExtractor stage found, rejecting the request if they
+// aren't allowed. The Authorizer may return a different (e.g. OPA-derived)
+// set of tenant values to enforce instead of the extracted ones.
+func (r *routes) authorizerMiddleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			values, ok := rawLabelValue(req.Context())
+			if !ok {
+				http.Error(w, "internal error: no label value extracted", http.StatusInternalServerError)
+				return
+			}
+
+			httpStatus, httpStatusText, allowed, err := r.authorizer.Authorize(req, values)
+			if httpStatus != http.StatusOK {
+				http.Error(w, fmt.Sprintf("%v: %v", httpStatusText, err), httpStatus)
+				return
+			}
+			if len(allowed) == 0 {
+				allowed = values
+			}
+
+			next.ServeHTTP(w, req.WithContext(withRawLabelValue(req.Context(), allowed...)))
+		})
+	}
+}
+
+// labelInjectorMiddleware moves the authorized label value(s) from the raw
+// context key onto the key query()/federate()/... read from, and strips
+// the label out of the proxied query string.
+func (r *routes) labelInjectorMiddleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			values, _ := rawLabelValue(req.Context())
+			req = req.WithContext(withLabelValue(req.Context(), values...))
+
+			q := req.URL.Query()
+			q.Del(r.label)
+			req.URL.RawQuery = q.Encode()
+
+			next.ServeHTTP(w, req)
+		})
+	}
+}
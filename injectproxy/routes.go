@@ -14,38 +14,60 @@
 package injectproxy
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"regexp"
 	"strings"
 	"unicode"
 
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql/parser"
-	"gopkg.in/square/go-jose.v2/json"
 )
 
 type routes struct {
-	upstream             *url.URL
-	handler              http.Handler
-	label                string
-	mux                  *http.ServeMux
-	modifiers            map[string]func(*http.Response) error
-	opaHTTPAuthzEndpoint string
+	upstream     *url.URL
+	handler      http.Handler
+	transport    http.RoundTripper
+	label        string
+	mux          *http.ServeMux
+	chain        http.Handler
+	modifiers    map[string]func(*http.Response) error
+	authorizer   Authorizer
+	jwtExtractor *jwtLabelExtractor
 }
 
-func NewRoutes(upstream *url.URL, label string, opaHTTPAuthzEndpoint string) *routes {
+// NewRoutes returns a routes that proxies to upstream, enforcing label on
+// every request. authorizer decides whether a request is allowed to see a
+// given label value; use NewHTTPAuthorizer for the legacy OPA-over-HTTP
+// behavior, NewRegoAuthorizer to evaluate policy in-process, NewNoopAuthorizer
+// to allow every request, or NewStaticAllowListAuthorizer for a fixed set of
+// values. jwtExtractor is optional: when set, the label value is pulled from
+// a verified bearer token instead of the query string; pass nil to keep the
+// existing query-string behavior.
+//
+// The request is processed by a chain of Middleware built from the
+// LabelExtractor, Authorizer and LabelInjector stages, in that order,
+// followed by extra (if any) before the request reaches the Enforcer
+// stage (the mux that dispatches to query(), federate(), ...). extra lets
+// callers insert their own cross-cutting concerns, such as rate limiting
+// or request logging, without editing this package.
+func NewRoutes(upstream *url.URL, label string, authorizer Authorizer, jwtExtractor *jwtLabelExtractor, extra ...Middleware) *routes {
 	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	transport := proxy.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
 
 	r := &routes{
-		upstream:             upstream,
-		handler:              proxy,
-		label:                label,
-		opaHTTPAuthzEndpoint: opaHTTPAuthzEndpoint,
+		upstream:     upstream,
+		handler:      proxy,
+		transport:    transport,
+		label:        label,
+		authorizer:   authorizer,
+		jwtExtractor: jwtExtractor,
 	}
 	mux := http.NewServeMux()
 	mux.Handle("/federate", enforceMethods(r.federate, "GET"))
@@ -53,119 +75,58 @@ func NewRoutes(upstream *url.URL, label string, opaHTTPAuthzEndpoint string) *ro
 	mux.Handle("/api/v1/query_range", enforceMethods(r.query, "GET", "POST"))
 	mux.Handle("/api/v1/alerts", enforceMethods(r.noop, "GET"))
 	mux.Handle("/api/v1/rules", enforceMethods(r.noop, "GET"))
+	mux.Handle("/api/v1/write", enforceMethods(r.write, "POST"))
 	mux.Handle("/api/v2/silences", enforceMethods(r.silences, "GET", "POST"))
 	mux.Handle("/api/v2/silences/", enforceMethods(r.silences, "GET", "POST"))
 	mux.Handle("/api/v2/silence/", enforceMethods(r.deleteSilence, "DELETE"))
 	r.mux = mux
 	r.modifiers = map[string]func(*http.Response) error{
-		"/api/v1/rules":  modifyAPIResponse(r.filterRules),
-		"/api/v1/alerts": modifyAPIResponse(r.filterAlerts),
+		"/api/v1/rules":    modifyAPIResponse(r.filterRules),
+		"/api/v1/alerts":   modifyAPIResponse(r.filterAlerts),
+		"/api/v2/silences": modifyAPIResponse(r.filterSilences),
 	}
 	proxy.ModifyResponse = r.ModifyResponse
+
+	middlewares := append([]Middleware{
+		r.labelExtractorMiddleware(),
+		r.authorizerMiddleware(),
+		r.labelInjectorMiddleware(),
+	}, extra...)
+	r.chain = chain(r.mux, middlewares...)
+
 	return r
 }
 
 func (r *routes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.chain.ServeHTTP(w, req)
+}
+
+// labelValues returns the tenant label value(s) to enforce for req. It
+// prefers a verified JWT claim when a jwtExtractor is configured, falling
+// back to mining the value out of the "query" parameter otherwise. A user
+// authorized for more than one tenant yields more than one value, e.g. from
+// a JWT array claim.
+func (r *routes) labelValues(req *http.Request) ([]string, error) {
+	if r.jwtExtractor != nil {
+		return r.jwtExtractor.Extract(req)
+	}
+
 	queryString := req.URL.Query().Get("query")
 	f := func(c rune) bool {
 		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
 	}
 	querySlice := strings.FieldsFunc(queryString, f)
-	index := 0
+	index := -1
 	for i := range querySlice {
 		if querySlice[i] == r.label {
 			index = i + 1
 			break
 		}
 	}
-	lvalue := querySlice[index]
-	// lvalue := req.URL.Query().Get(r.label)
-	if lvalue == "" {
-		http.Error(w, fmt.Sprintf("Bad request. The %q query parameter must be provided.", r.label), http.StatusBadRequest)
-		return
+	if index < 0 || index >= len(querySlice) || querySlice[index] == "" {
+		return nil, fmt.Errorf("the %q query parameter must be provided", r.label)
 	}
-
-	// authorize request with opa
-	httpStatus, httpStatusText, err := r.isUserAuthorized(req, lvalue)
-	if httpStatus != http.StatusOK {
-		http.Error(w, fmt.Sprintf("%v: %v", httpStatusText, err), httpStatus)
-		return
-	}
-
-	req = req.WithContext(withLabelValue(req.Context(), lvalue))
-	// Remove the proxy label from the query parameters.
-	q := req.URL.Query()
-	q.Del(r.label)
-	req.URL.RawQuery = q.Encode()
-
-	r.mux.ServeHTTP(w, req)
-}
-
-type opaPayload struct {
-	Input struct {
-		HTTP struct {
-			Headers map[string]string `json:"headers"`
-		} `json:"http"`
-		Label map[string]string `json:"label"`
-	} `json:"input"`
-}
-
-type opaResponse struct {
-	Result struct {
-		Allow bool `json:"allow"`
-	} `json:"result"`
-}
-
-func (r *routes) isUserAuthorized(req *http.Request, val string) (int, string, error) {
-	var opaPayload opaPayload
-	var errorString string
-
-	bearerToken := req.Header.Get("Authorization")
-	label := make(map[string]string)
-	label[r.label] = val
-	headers := make(map[string]string)
-	headers["authorization"] = "Bearer " + bearerToken
-	opaPayload.Input.HTTP.Headers = headers
-	opaPayload.Input.Label = label
-
-	payload, err := json.Marshal(opaPayload)
-	if err != nil {
-		errorString = fmt.Sprintf("%v %v - failed to marshal OPA payload", http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
-		return http.StatusInternalServerError, errorString, err
-	}
-	opaHTTPAuthzEndpoint := r.opaHTTPAuthzEndpoint
-	opaReq, err := http.NewRequest("POST", opaHTTPAuthzEndpoint, bytes.NewBuffer(payload))
-	if err != nil {
-		errorString = fmt.Sprintf("%v %v - failed to create OPA HTTP request", http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
-		return http.StatusInternalServerError, errorString, err
-	}
-	client := &http.Client{}
-	resp, err := client.Do(opaReq)
-	if err != nil {
-		errorString = fmt.Sprintf("%v %v - failed to execute OPA HTTP request", http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
-		return http.StatusInternalServerError, errorString, err
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		errorString = fmt.Sprintf("%v %v - failed to read OPA response body", http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
-		return http.StatusInternalServerError, errorString, err
-	}
-
-	opaResponse := &opaResponse{}
-	err = json.Unmarshal(body, opaResponse)
-	if err != nil {
-		errorString = fmt.Sprintf("%v %v - failed to unmarshal to OPA response struct", http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
-		return http.StatusInternalServerError, errorString, err
-	}
-
-	if opaResponse.Result.Allow {
-		return http.StatusOK, http.StatusText(http.StatusOK), nil
-	}
-
-	errorString = fmt.Sprintf("%v %v - User not authorized", http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
-	return http.StatusUnauthorized, errorString, err
+	return []string{querySlice[index]}, nil
 }
 
 func (r *routes) ModifyResponse(resp *http.Response) error {
@@ -191,28 +152,66 @@ func enforceMethods(h http.HandlerFunc, methods ...string) http.Handler {
 
 type ctxKey int
 
-const keyLabel ctxKey = iota
+const (
+	keyLabel ctxKey = iota
+	keyRawLabel
+)
 
-func mustLabelValue(ctx context.Context) string {
-	label, ok := ctx.Value(keyLabel).(string)
-	if !ok {
+// mustLabelValues returns the one or more label values a request has been
+// authorized for. It panics if none were set on the context, which would
+// indicate a bug in the middleware chain rather than a user error.
+func mustLabelValues(ctx context.Context) []string {
+	values, ok := ctx.Value(keyLabel).([]string)
+	if !ok || len(values) == 0 {
 		panic(fmt.Sprintf("can't find the %q value in the context", keyLabel))
 	}
-	if label == "" {
-		panic(fmt.Sprintf("empty %q value in the context", keyLabel))
-	}
 
-	return label
+	return values
 }
 
-func withLabelValue(ctx context.Context, label string) context.Context {
-	return context.WithValue(ctx, keyLabel, label)
+func withLabelValue(ctx context.Context, values ...string) context.Context {
+	return context.WithValue(ctx, keyLabel, values)
+}
+
+// withRawLabelValue stores the label value(s) found by the LabelExtractor
+// stage, before they have been through the Authorizer stage.
+func withRawLabelValue(ctx context.Context, values ...string) context.Context {
+	return context.WithValue(ctx, keyRawLabel, values)
+}
+
+func rawLabelValue(ctx context.Context) ([]string, bool) {
+	values, ok := ctx.Value(keyRawLabel).([]string)
+	return values, ok
 }
 
 func (r *routes) noop(w http.ResponseWriter, req *http.Request) {
 	r.handler.ServeHTTP(w, req)
 }
 
+// labelMatcher returns a matcher for label that selects exactly values. A
+// single value produces an equality matcher, as before; more than one
+// (e.g. a user authorized for several tenants) produces an anchored
+// regexp alternation instead.
+func labelMatcher(label string, values []string) *labels.Matcher {
+	if len(values) == 1 {
+		return &labels.Matcher{
+			Name:  label,
+			Type:  labels.MatchEqual,
+			Value: values[0],
+		}
+	}
+
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = regexp.QuoteMeta(v)
+	}
+	return &labels.Matcher{
+		Name:  label,
+		Type:  labels.MatchRegexp,
+		Value: fmt.Sprintf("^(%s)$", strings.Join(quoted, "|")),
+	}
+}
+
 func (r *routes) query(w http.ResponseWriter, req *http.Request) {
 	expr, err := parser.ParseExpr(req.FormValue("query"))
 	if err != nil {
@@ -220,11 +219,7 @@ func (r *routes) query(w http.ResponseWriter, req *http.Request) {
 	}
 
 	e := NewEnforcer([]*labels.Matcher{
-		{
-			Name:  r.label,
-			Type:  labels.MatchEqual,
-			Value: mustLabelValue(req.Context()),
-		},
+		labelMatcher(r.label, mustLabelValues(req.Context())),
 	}...)
 	if err := e.EnforceNode(expr); err != nil {
 		return
@@ -238,11 +233,7 @@ func (r *routes) query(w http.ResponseWriter, req *http.Request) {
 }
 
 func (r *routes) federate(w http.ResponseWriter, req *http.Request) {
-	matcher := &labels.Matcher{
-		Name:  r.label,
-		Type:  labels.MatchEqual,
-		Value: mustLabelValue(req.Context()),
-	}
+	matcher := labelMatcher(r.label, mustLabelValues(req.Context()))
 
 	q := req.URL.Query()
 	q.Set("match[]", "{"+matcher.String()+"}")
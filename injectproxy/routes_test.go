@@ -0,0 +1,51 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestLabelMatcher(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		values []string
+		want   labels.Matcher
+	}{
+		{
+			name:   "single value produces an equality matcher",
+			values: []string{"team-a"},
+			want:   labels.Matcher{Type: labels.MatchEqual, Name: "namespace", Value: "team-a"},
+		},
+		{
+			name:   "multiple values produce an anchored regexp alternation",
+			values: []string{"team-a", "team-b"},
+			want:   labels.Matcher{Type: labels.MatchRegexp, Name: "namespace", Value: "^(team-a|team-b)$"},
+		},
+		{
+			name:   "regexp metacharacters in values are quoted",
+			values: []string{"team.a", "team+b"},
+			want:   labels.Matcher{Type: labels.MatchRegexp, Name: "namespace", Value: `^(team\.a|team\+b)$`},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := labelMatcher("namespace", tc.values)
+			if got.Type != tc.want.Type || got.Name != tc.want.Name || got.Value != tc.want.Value {
+				t.Fatalf("got %+v, want %+v", *got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// write decodes a Prometheus remote_write request, injects the tenant
+// label into every time series it carries, and forwards the re-encoded
+// request upstream. A caller authorized for more than one tenant (e.g. a
+// JWT array claim or an OPA tenants override) must disambiguate some
+// other way - remote_write has nowhere to carry that choice, and picking
+// one silently would risk tagging data with the wrong tenant depending
+// on extraction order, which isn't guaranteed stable across requests.
+func (r *routes) write(w http.ResponseWriter, req *http.Request) {
+	values := mustLabelValues(req.Context())
+	if len(values) != 1 {
+		http.Error(w, fmt.Sprintf("Bad request. remote_write requires exactly one authorized %q value, got %d", r.label, len(values)), http.StatusBadRequest)
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad request. failed to read remote_write request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	req.Body.Close()
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad request. failed to decompress remote_write request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var wr prompb.WriteRequest
+	if err := proto.Unmarshal(data, &wr); err != nil {
+		http.Error(w, fmt.Sprintf("Bad request. failed to unmarshal remote_write request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	for i := range wr.Timeseries {
+		injectLabel(&wr.Timeseries[i], r.label, values[0])
+	}
+
+	out, err := proto.Marshal(&wr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to re-marshal remote_write request: %v", err), http.StatusInternalServerError)
+		return
+	}
+	encoded := snappy.Encode(nil, out)
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(encoded))
+	req.ContentLength = int64(len(encoded))
+
+	r.handler.ServeHTTP(w, req)
+}
+
+// injectLabel sets name to value on ts, overwriting any existing label of
+// that name.
+func injectLabel(ts *prompb.TimeSeries, name, value string) {
+	for i := range ts.Labels {
+		if ts.Labels[i].Name == name {
+			ts.Labels[i].Value = value
+			return
+		}
+	}
+	ts.Labels = append(ts.Labels, prompb.Label{Name: name, Value: value})
+}
+
+// silences enforces the tenant label on Alertmanager silences. GET
+// requests are passed through to the upstream list endpoint and have
+// their response filtered down to the caller's own silences by
+// filterSilences; POST requests have their matchers rewritten to include
+// the tenant label, and are rejected if they already carry a matcher for
+// that label (which would let a caller silence alerts belonging to a
+// different tenant).
+func (r *routes) silences(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		r.handler.ServeHTTP(w, req)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad request. failed to read silence body: %v", err), http.StatusBadRequest)
+		return
+	}
+	req.Body.Close()
+
+	var sil map[string]interface{}
+	if err := json.Unmarshal(body, &sil); err != nil {
+		http.Error(w, fmt.Sprintf("Bad request. failed to decode silence: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	matchers, _ := sil["matchers"].([]interface{})
+	for _, m := range matchers {
+		mm, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if name, _ := mm["name"].(string); name == r.label {
+			http.Error(w, fmt.Sprintf("Bad request. silence must not set its own %q matcher", r.label), http.StatusBadRequest)
+			return
+		}
+	}
+
+	matcher := labelMatcher(r.label, mustLabelValues(req.Context()))
+	sil["matchers"] = append(matchers, map[string]interface{}{
+		"name":    matcher.Name,
+		"value":   matcher.Value,
+		"isRegex": matcher.Type == labels.MatchRegexp,
+		"isEqual": true,
+	})
+
+	newBody, err := json.Marshal(sil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to re-encode silence: %v", err), http.StatusInternalServerError)
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(newBody))
+	req.ContentLength = int64(len(newBody))
+
+	r.handler.ServeHTTP(w, req)
+}
+
+// filterSilences restricts a GET /api/v2/silences response to only the
+// silences that carry a matcher for the caller's own tenant label,
+// mirroring filterRules/filterAlerts: without it, any authenticated
+// tenant could list every other tenant's silences. /api/v2/silences also
+// accepts POST (silence creation), whose response is a single object
+// rather than an array, so this only touches GET responses.
+func (r *routes) filterSilences(resp *http.Response) error {
+	if resp.Request.Method != http.MethodGet {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	var sils []map[string]interface{}
+	if err := json.Unmarshal(body, &sils); err != nil {
+		return err
+	}
+
+	values := mustLabelValues(resp.Request.Context())
+	filtered := sils[:0]
+	for _, sil := range sils {
+		if silenceMatches(sil, r.label, values) {
+			filtered = append(filtered, sil)
+		}
+	}
+
+	out, err := json.Marshal(filtered)
+	if err != nil {
+		return err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(out))
+	resp.ContentLength = int64(len(out))
+	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(out)))
+	return nil
+}
+
+// deleteSilence only forwards the DELETE once it has confirmed, via a GET
+// against the upstream Alertmanager, that the silence being deleted
+// carries a matcher for the caller's tenant label.
+func (r *routes) deleteSilence(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/api/v2/silence/")
+
+	sil, err := r.fetchSilence(req, id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad request. failed to fetch silence %q: %v", id, err), http.StatusBadRequest)
+		return
+	}
+
+	values := mustLabelValues(req.Context())
+	if !silenceMatches(sil, r.label, values) {
+		http.Error(w, fmt.Sprintf("silence %q does not belong to tenant(s) %v", id, values), http.StatusForbidden)
+		return
+	}
+
+	r.handler.ServeHTTP(w, req)
+}
+
+// fetchSilence retrieves the current state of the silence identified by id
+// directly from upstream, using the caller's own credentials. It goes out
+// over r.transport, the same RoundTripper the reverse proxy uses for every
+// other upstream request, so it picks up any TLS/mTLS configuration instead
+// of silently falling back to http.DefaultClient's defaults.
+func (r *routes) fetchSilence(req *http.Request, id string) (map[string]interface{}, error) {
+	u := *r.upstream
+	u.Path = path.Join(u.Path, "/api/v2/silence", id)
+
+	getReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	getReq.Header = req.Header
+
+	client := http.Client{Transport: r.transport}
+	resp, err := client.Do(getReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned %s", resp.Status)
+	}
+
+	var sil map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&sil); err != nil {
+		return nil, err
+	}
+	return sil, nil
+}
+
+// silenceMatches reports whether sil carries a matcher for label whose
+// value(s) are exactly the given tenant values. Values are compared as a
+// set rather than as the raw matcher string labelMatcher would generate:
+// for a multi-tenant caller that string is a regexp alternation built by
+// iterating values in whatever order they were extracted in (e.g. a JWT
+// array claim), which has no stability guarantee across requests, so
+// comparing it verbatim against the matcher stored on the silence would
+// spuriously reject a legitimate owner's delete.
+func silenceMatches(sil map[string]interface{}, label string, values []string) bool {
+	want := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		want[v] = struct{}{}
+	}
+
+	matchers, _ := sil["matchers"].([]interface{})
+	for _, m := range matchers {
+		mm, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if name, _ := mm["name"].(string); name != label {
+			continue
+		}
+
+		got := silenceMatcherValues(mm)
+		if len(got) != len(want) {
+			continue
+		}
+		match := true
+		for _, v := range got {
+			if _, ok := want[v]; !ok {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// silenceMatcherValues extracts the set of label values a silence matcher
+// selects, undoing the regexp alternation labelMatcher builds for more
+// than one value (including the per-value regexp.QuoteMeta escaping, so
+// a tenant name containing a regex metacharacter round-trips correctly).
+func silenceMatcherValues(matcher map[string]interface{}) []string {
+	value, _ := matcher["value"].(string)
+	isRegex, _ := matcher["isRegex"].(bool)
+	if !isRegex {
+		return []string{value}
+	}
+
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(value, "^("), ")$")
+	return splitQuotedAlternation(trimmed)
+}
+
+// splitQuotedAlternation splits a "|"-joined alternation of
+// regexp.QuoteMeta-escaped values back into the original values, treating
+// a backslash as escaping the character that follows it rather than as a
+// separator.
+func splitQuotedAlternation(s string) []string {
+	var values []string
+	var cur strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			cur.WriteByte(s[i+1])
+			i++
+		case c == '|':
+			values = append(values, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	values = append(values, cur.String())
+	return values
+}
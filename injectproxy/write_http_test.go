@@ -0,0 +1,303 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// fixedAuthorizer always authorizes the given tenant values, regardless of
+// what the LabelExtractor stage found, so tests can exercise a request
+// authorized for a specific (possibly multi-tenant) set without needing a
+// real OPA server or JWT.
+type fixedAuthorizer struct {
+	values []string
+}
+
+func (a fixedAuthorizer) Authorize(*http.Request, []string) (int, string, []string, error) {
+	return http.StatusOK, http.StatusText(http.StatusOK), a.values, nil
+}
+
+func encodeWriteRequest(t *testing.T, wr *prompb.WriteRequest) []byte {
+	t.Helper()
+	data, err := proto.Marshal(wr)
+	if err != nil {
+		t.Fatalf("failed to marshal write request: %v", err)
+	}
+	return snappy.Encode(nil, data)
+}
+
+func decodeWriteRequest(t *testing.T, body []byte) *prompb.WriteRequest {
+	t.Helper()
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatalf("failed to decompress write request: %v", err)
+	}
+	var wr prompb.WriteRequest
+	if err := proto.Unmarshal(data, &wr); err != nil {
+		t.Fatalf("failed to unmarshal write request: %v", err)
+	}
+	return &wr
+}
+
+// TestWriteWithoutJWTConfigured is a regression test for labelValues
+// panicking with "index out of range" on any request with no "query" URL
+// parameter (e.g. a real remote_write request) when no jwtExtractor is
+// configured. It must fail cleanly with 400, not panic.
+func TestWriteWithoutJWTConfigured(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Fatal("request must not reach upstream")
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("failed to parse upstream URL: %v", err)
+	}
+	r := NewRoutes(u, "namespace", NewNoopAuthorizer(), nil)
+
+	body := encodeWriteRequest(t, &prompb.WriteRequest{})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	r.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestWriteInjectsLabel(t *testing.T) {
+	var gotBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatalf("failed to read forwarded body: %v", err)
+		}
+		gotBody = body
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("failed to parse upstream URL: %v", err)
+	}
+	r := NewRoutes(u, "namespace", fixedAuthorizer{values: []string{"team-a"}}, nil)
+
+	body := encodeWriteRequest(t, &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{{}},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/write?query=namespace+x", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	r.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d, body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	wr := decodeWriteRequest(t, gotBody)
+	if len(wr.Timeseries) != 1 || len(wr.Timeseries[0].Labels) != 1 {
+		t.Fatalf("got timeseries %+v, want a single series with the injected label", wr.Timeseries)
+	}
+	if got := wr.Timeseries[0].Labels[0]; got.Name != "namespace" || got.Value != "team-a" {
+		t.Fatalf("got label %+v, want namespace=team-a", got)
+	}
+}
+
+// TestWriteRejectsMultipleTenantValues is a regression test: write() used
+// to silently take only the first of several authorized tenant values,
+// which isn't guaranteed to be stable across requests.
+func TestWriteRejectsMultipleTenantValues(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Fatal("request must not reach upstream")
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("failed to parse upstream URL: %v", err)
+	}
+	r := NewRoutes(u, "namespace", fixedAuthorizer{values: []string{"team-a", "team-b"}}, nil)
+
+	body := encodeWriteRequest(t, &prompb.WriteRequest{})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/write?query=namespace+x", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	r.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSilencesGETFiltersOtherTenants(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"id": "1", "matchers": []interface{}{
+				map[string]interface{}{"name": "namespace", "value": "team-a", "isRegex": false},
+			}},
+			{"id": "2", "matchers": []interface{}{
+				map[string]interface{}{"name": "namespace", "value": "team-b", "isRegex": false},
+			}},
+		})
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("failed to parse upstream URL: %v", err)
+	}
+	r := NewRoutes(u, "namespace", fixedAuthorizer{values: []string{"team-a"}}, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v2/silences?query=namespace+x", nil)
+	rec := httptest.NewRecorder()
+
+	r.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d, body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	var sils []map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &sils); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(sils) != 1 || sils[0]["id"] != "1" {
+		t.Fatalf("got silences %+v, want only the team-a silence", sils)
+	}
+}
+
+func TestSilencesPOSTRejectsOwnLabelMatcher(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Fatal("request must not reach upstream")
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("failed to parse upstream URL: %v", err)
+	}
+	r := NewRoutes(u, "namespace", fixedAuthorizer{values: []string{"team-a"}}, nil)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"matchers": []interface{}{
+			map[string]interface{}{"name": "namespace", "value": "team-b", "isRegex": false},
+		},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/v2/silences?query=namespace+x", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	r.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSilencesPOSTInjectsTenantMatcher(t *testing.T) {
+	var gotBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatalf("failed to read forwarded body: %v", err)
+		}
+		gotBody = body
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("failed to parse upstream URL: %v", err)
+	}
+	r := NewRoutes(u, "namespace", fixedAuthorizer{values: []string{"team-a"}}, nil)
+
+	body, _ := json.Marshal(map[string]interface{}{"matchers": []interface{}{}})
+	req := httptest.NewRequest(http.MethodPost, "/api/v2/silences?query=namespace+x", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	r.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d, body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	var sil map[string]interface{}
+	if err := json.Unmarshal(gotBody, &sil); err != nil {
+		t.Fatalf("failed to decode forwarded silence: %v", err)
+	}
+	if !silenceMatches(sil, "namespace", []string{"team-a"}) {
+		t.Fatalf("got silence %+v, want a namespace=team-a matcher", sil)
+	}
+}
+
+func TestDeleteSilence(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		values     []string
+		wantStatus int
+	}{
+		{name: "owner can delete", values: []string{"team-a"}, wantStatus: http.StatusOK},
+		{name: "other tenant cannot delete", values: []string{"team-b"}, wantStatus: http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var deleted bool
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				switch req.Method {
+				case http.MethodGet:
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"id": "1",
+						"matchers": []interface{}{
+							map[string]interface{}{"name": "namespace", "value": "team-a", "isRegex": false},
+						},
+					})
+				case http.MethodDelete:
+					deleted = true
+					w.WriteHeader(http.StatusOK)
+				}
+			}))
+			defer upstream.Close()
+
+			u, err := url.Parse(upstream.URL)
+			if err != nil {
+				t.Fatalf("failed to parse upstream URL: %v", err)
+			}
+			r := NewRoutes(u, "namespace", fixedAuthorizer{values: tc.values}, nil)
+
+			req := httptest.NewRequest(http.MethodDelete, "/api/v2/silence/1?query=namespace+x", nil)
+			rec := httptest.NewRecorder()
+
+			r.ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("got status %d, want %d, body: %s", rec.Code, tc.wantStatus, rec.Body.String())
+			}
+			if deleted != (tc.wantStatus == http.StatusOK) {
+				t.Fatalf("got deleted=%v, want %v", deleted, tc.wantStatus == http.StatusOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import "testing"
+
+func TestSilenceMatches(t *testing.T) {
+	newSilence := func(matchers ...map[string]interface{}) map[string]interface{} {
+		ms := make([]interface{}, len(matchers))
+		for i, m := range matchers {
+			ms[i] = m
+		}
+		return map[string]interface{}{"matchers": ms}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		sil    map[string]interface{}
+		label  string
+		values []string
+		want   bool
+	}{
+		{
+			name: "single tenant equality matcher",
+			sil: newSilence(map[string]interface{}{
+				"name": "namespace", "value": "team-a", "isRegex": false,
+			}),
+			label:  "namespace",
+			values: []string{"team-a"},
+			want:   true,
+		},
+		{
+			name: "multi-tenant regexp matcher, same order",
+			sil: newSilence(map[string]interface{}{
+				"name": "namespace", "value": "^(team-a|team-b)$", "isRegex": true,
+			}),
+			label:  "namespace",
+			values: []string{"team-a", "team-b"},
+			want:   true,
+		},
+		{
+			// Regression test: the JWT array claim (or OPA tenants
+			// response) that values comes from has no stable ordering
+			// across requests, so a silence created while authorized
+			// for ["team-b", "team-a"] must still match a later delete
+			// authorized for ["team-a", "team-b"].
+			name: "multi-tenant regexp matcher, different order still matches",
+			sil: newSilence(map[string]interface{}{
+				"name": "namespace", "value": "^(team-b|team-a)$", "isRegex": true,
+			}),
+			label:  "namespace",
+			values: []string{"team-a", "team-b"},
+			want:   true,
+		},
+		{
+			name: "different tenant set does not match",
+			sil: newSilence(map[string]interface{}{
+				"name": "namespace", "value": "^(team-a|team-b)$", "isRegex": true,
+			}),
+			label:  "namespace",
+			values: []string{"team-a", "team-c"},
+			want:   false,
+		},
+		{
+			// labelMatcher quotes each value with regexp.QuoteMeta before
+			// joining them, so a tenant name containing a metacharacter
+			// must be unescaped back to its original form to compare.
+			name: "multi-tenant regexp matcher with quoted metacharacters",
+			sil: newSilence(map[string]interface{}{
+				"name": "namespace", "value": `^(team\.a|team\+b)$`, "isRegex": true,
+			}),
+			label:  "namespace",
+			values: []string{"team.a", "team+b"},
+			want:   true,
+		},
+		{
+			name: "different label name does not match",
+			sil: newSilence(map[string]interface{}{
+				"name": "other", "value": "team-a", "isRegex": false,
+			}),
+			label:  "namespace",
+			values: []string{"team-a"},
+			want:   false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := silenceMatches(tc.sil, tc.label, tc.values); got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}